@@ -0,0 +1,19 @@
+package cache
+
+import "time"
+
+// Backend stores the raw, serialized bytes of a cache entry. QueryCache
+// owns all TTL, stale-serving and DO/CD semantics, but passes its
+// lifetime for the entry through to Set so backends that can expire keys
+// on their own (Redis, BadgerDB) reclaim them without ever needing a Get.
+// A Backend only needs to remember what it was given until ttl elapses or
+// it's asked to forget it, which is what lets the same entry format be
+// backed by memory, Redis or BadgerDB interchangeably.
+type Backend interface {
+	Set(key uint64, data []byte, ttl time.Duration) error
+	Get(key uint64) ([]byte, error)
+	Exists(key uint64) bool
+	Remove(key uint64)
+	Length() int
+	clear()
+}
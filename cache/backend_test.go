@@ -0,0 +1,95 @@
+package cache
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+	"github.com/jonboulle/clockwork"
+	"github.com/miekg/dns"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+)
+
+// backendHarness exercises a Backend the same way regardless of what's
+// behind it, so memory, Redis and BadgerDB are all held to the same
+// contract.
+func backendHarness(t *testing.T, backend Backend) {
+	t.Helper()
+
+	WallClock = clockwork.NewFakeClock()
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 30},
+		A:   net.ParseIP("1.2.3.4"),
+	})
+
+	key := Hash(m.Question[0], false, false)
+
+	raw, err := encodeEntry(WallClock.Now(), m)
+	assert.NoError(t, err)
+
+	assert.NoError(t, backend.Set(key, raw, 30*time.Second))
+	assert.True(t, backend.Exists(key))
+	assert.Equal(t, 1, backend.Length())
+
+	got, err := backend.Get(key)
+	assert.NoError(t, err)
+
+	_, msg, err := decodeEntry(got)
+	assert.NoError(t, err)
+	assert.Equal(t, "example.com.", msg.Question[0].Name)
+
+	backend.Remove(key)
+	assert.False(t, backend.Exists(key))
+
+	_, err = backend.Get(key)
+	assert.Equal(t, ErrCacheNotFound, err)
+
+	assert.NoError(t, backend.Set(key, raw, 30*time.Second))
+	backend.clear()
+	assert.Equal(t, 0, backend.Length())
+}
+
+func Test_Backends(t *testing.T) {
+	t.Run("memory", func(t *testing.T) {
+		backendHarness(t, newMemoryBackend())
+	})
+
+	t.Run("redis", func(t *testing.T) {
+		addr := os.Getenv("SDNS_TEST_REDIS_ADDR")
+		if addr == "" {
+			addr = "127.0.0.1:6379"
+		}
+
+		conn, err := net.DialTimeout("tcp", addr, 200*time.Millisecond)
+		if err != nil {
+			t.Skipf("redis not reachable at %s: %v", addr, err)
+		}
+		conn.Close()
+
+		client := redis.NewClient(&redis.Options{Addr: addr})
+		defer client.Close()
+
+		backend := NewRedisBackend(client, "sdns:test:")
+		defer backend.clear()
+
+		backendHarness(t, backend)
+	})
+
+	t.Run("badger", func(t *testing.T) {
+		opts := badger.DefaultOptions(t.TempDir()).WithLogger(nil)
+
+		db, err := badger.Open(opts)
+		if err != nil {
+			t.Fatalf("open badger: %v", err)
+		}
+		defer db.Close()
+
+		backendHarness(t, NewBadgerBackend(db))
+	})
+}
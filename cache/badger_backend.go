@@ -0,0 +1,98 @@
+package cache
+
+import (
+	"strconv"
+	"time"
+
+	badger "github.com/dgraph-io/badger/v4"
+)
+
+// BadgerBackend persists entries to an embedded BadgerDB so a single sdns
+// instance can keep a warm cache across restarts without any external
+// service to run.
+type BadgerBackend struct {
+	db *badger.DB
+}
+
+// NewBadgerBackend returns a Backend backed by the already-open db.
+// Callers are responsible for opening and closing db.
+func NewBadgerBackend(db *badger.DB) *BadgerBackend {
+	return &BadgerBackend{db: db}
+}
+
+func badgerKey(key uint64) []byte {
+	return []byte(strconv.FormatUint(key, 10))
+}
+
+func (b *BadgerBackend) Set(key uint64, data []byte, ttl time.Duration) error {
+	return b.db.Update(func(txn *badger.Txn) error {
+		entry := badger.NewEntry(badgerKey(key), data)
+		if ttl > 0 {
+			entry = entry.WithTTL(ttl)
+		}
+
+		return txn.SetEntry(entry)
+	})
+}
+
+func (b *BadgerBackend) Get(key uint64) ([]byte, error) {
+	var out []byte
+
+	err := b.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(badgerKey(key))
+		if err != nil {
+			return err
+		}
+
+		return item.Value(func(val []byte) error {
+			out = append([]byte(nil), val...)
+			return nil
+		})
+	})
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrCacheNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func (b *BadgerBackend) Exists(key uint64) bool {
+	err := b.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(badgerKey(key))
+		return err
+	})
+
+	return err == nil
+}
+
+func (b *BadgerBackend) Remove(key uint64) {
+	_ = b.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(badgerKey(key))
+	})
+}
+
+func (b *BadgerBackend) Length() int {
+	count := 0
+
+	_ = b.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Rewind(); it.Valid(); it.Next() {
+			count++
+		}
+
+		return nil
+	})
+
+	return count
+}
+
+func (b *BadgerBackend) clear() {
+	_ = b.db.DropAll()
+}
@@ -0,0 +1,87 @@
+package cache
+
+import (
+	"sync"
+	"time"
+)
+
+// memoryBackend is the default, in-process Backend. It never blocks on
+// anything but its own mutex and is what NewQueryCache uses unless told
+// otherwise. It has no use for ttl: expiry is handled by QueryCache's
+// janitor, which enumerates it directly via keys().
+type memoryBackend struct {
+	mu   sync.RWMutex
+	data map[uint64][]byte
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{data: make(map[uint64][]byte)}
+}
+
+func (b *memoryBackend) Set(key uint64, data []byte, ttl time.Duration) error {
+	cp := make([]byte, len(data))
+	copy(cp, data)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.data[key] = cp
+
+	return nil
+}
+
+func (b *memoryBackend) Get(key uint64) ([]byte, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	data, ok := b.data[key]
+	if !ok {
+		return nil, ErrCacheNotFound
+	}
+
+	return data, nil
+}
+
+func (b *memoryBackend) Exists(key uint64) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	_, ok := b.data[key]
+
+	return ok
+}
+
+func (b *memoryBackend) Remove(key uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.data, key)
+}
+
+func (b *memoryBackend) Length() int {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return len(b.data)
+}
+
+func (b *memoryBackend) clear() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.data = make(map[uint64][]byte)
+}
+
+// keys returns a snapshot of the currently stored keys, used by
+// QueryCache's background janitor.
+func (b *memoryBackend) keys() []uint64 {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	keys := make([]uint64, 0, len(b.data))
+	for k := range b.data {
+		keys = append(keys, k)
+	}
+
+	return keys
+}
@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics holds the Prometheus collectors a QueryCache reports through. A
+// nil *Metrics is valid anywhere one is accepted - every recording method
+// is a no-op on a nil receiver, so instrumentation is entirely optional.
+type Metrics struct {
+	hits      prometheus.Counter
+	misses    prometheus.Counter
+	expired   prometheus.Counter
+	size      prometheus.Gauge
+	evictions *prometheus.CounterVec
+	entryTTL  prometheus.Histogram
+
+	handler http.Handler
+}
+
+// NewMetrics creates the cache's Prometheus collectors and registers them
+// on reg. The returned Metrics also exposes a ready-to-mount /metrics
+// handler scoped to that same registry.
+func NewMetrics(reg *prometheus.Registry) *Metrics {
+	m := &Metrics{
+		hits: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sdns_cache_hits_total",
+			Help: "Total number of cache lookups that returned a cached answer.",
+		}),
+		misses: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sdns_cache_misses_total",
+			Help: "Total number of cache lookups for a key not present in the cache.",
+		}),
+		expired: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sdns_cache_expired_total",
+			Help: "Total number of cache lookups that found a key past its TTL and serve-stale window.",
+		}),
+		size: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "sdns_cache_size",
+			Help: "Current number of entries held in the cache.",
+		}),
+		evictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sdns_cache_evictions_total",
+			Help: "Total number of entries removed from the cache, or refused on Set because it was full (reason=capacity), by reason.",
+		}, []string{"reason"}),
+		entryTTL: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "sdns_cache_entry_ttl_seconds",
+			Help:    "TTL, in seconds, of entries stored in the cache, sampled on Set.",
+			Buckets: prometheus.ExponentialBuckets(1, 2, 16),
+		}),
+	}
+
+	reg.MustRegister(m.hits, m.misses, m.expired, m.size, m.evictions, m.entryTTL)
+
+	m.handler = promhttp.HandlerFor(reg, promhttp.HandlerOpts{})
+
+	return m
+}
+
+// Handler returns the /metrics HTTP handler for this Metrics' registry, or
+// a 404 handler if m is nil.
+func (m *Metrics) Handler() http.Handler {
+	if m == nil {
+		return http.NotFoundHandler()
+	}
+
+	return m.handler
+}
+
+func (m *Metrics) recordHit() {
+	if m == nil {
+		return
+	}
+
+	m.hits.Inc()
+}
+
+func (m *Metrics) recordMiss() {
+	if m == nil {
+		return
+	}
+
+	m.misses.Inc()
+}
+
+func (m *Metrics) recordExpired() {
+	if m == nil {
+		return
+	}
+
+	m.expired.Inc()
+}
+
+func (m *Metrics) recordEviction(reason string) {
+	if m == nil {
+		return
+	}
+
+	m.evictions.WithLabelValues(reason).Inc()
+}
+
+func (m *Metrics) observeSize(n int) {
+	if m == nil {
+		return
+	}
+
+	m.size.Set(float64(n))
+}
+
+func (m *Metrics) observeTTL(seconds uint32) {
+	if m == nil {
+		return
+	}
+
+	m.entryTTL.Observe(float64(seconds))
+}
@@ -0,0 +1,592 @@
+// Package cache implements a DNS response cache with TTL decay, optional
+// serve-stale/prefetch behaviour and pluggable storage backends.
+package cache
+
+import (
+	"encoding/binary"
+	"errors"
+	"hash/fnv"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jonboulle/clockwork"
+	"github.com/miekg/dns"
+	"golang.org/x/sync/singleflight"
+)
+
+// WallClock is used everywhere instead of time.Now so tests can fake it.
+var WallClock = clockwork.NewRealClock()
+
+var (
+	// ErrCacheExpired is returned the first time a query for an expired key is made.
+	ErrCacheExpired = errors.New("cache expired")
+	// ErrCacheNotFound is returned when the key does not exist in the cache.
+	ErrCacheNotFound = errors.New("cache not found")
+	// ErrCacheFull is returned by Set when the cache is already at capacity.
+	ErrCacheFull = errors.New("capacity full")
+)
+
+// Refresher looks up a fresh answer for the question carried by req. It is
+// invoked asynchronously when a stale entry is served.
+type Refresher func(req *dns.Msg) (*dns.Msg, error)
+
+// timestampLen is the size, in bytes, of the insertion-time header that
+// precedes every packed *dns.Msg a QueryCache hands to its Backend.
+const timestampLen = 8
+
+// QueryCache is a capacity-bounded, TTL-aware cache of DNS responses. It
+// owns all cache semantics; the Backend it's built on is only responsible
+// for remembering opaque, already-serialized entries.
+type QueryCache struct {
+	backend Backend
+
+	capacity int
+
+	// prefetchTTL is the number of seconds past expiry that a stale entry
+	// may still be served while it is refreshed in the background. Zero
+	// disables serve-stale entirely.
+	prefetchTTL int
+	refresher   Refresher
+
+	sf        singleflight.Group
+	inflight  map[uint64]struct{}
+	inflightL sync.Mutex
+
+	// notified tracks keys that have already surfaced ErrCacheExpired once,
+	// so the next Get can tell a client "not found" and reclaim the entry -
+	// mirroring the old in-memory behaviour regardless of backend.
+	notified  map[uint64]struct{}
+	notifiedL sync.Mutex
+
+	// minNegativeTTL/maxNegativeTTL bound the SOA-derived lifetime of
+	// NXDOMAIN/NODATA entries (RFC 2308). Zero means "no bound". Guarded by
+	// negL since SetNegativeTTLBounds may be called after construction.
+	minNegativeTTL int
+	maxNegativeTTL int
+	negL           sync.RWMutex
+
+	positiveHits atomic.Uint64
+	negativeHits atomic.Uint64
+
+	metrics *Metrics
+
+	stopCh chan struct{}
+	done   chan struct{}
+}
+
+// NewQueryCache returns a QueryCache holding at most maxcount entries in
+// memory. prefetchTTL is the serve-stale window in seconds (RFC 8767);
+// when it is greater than zero and refresher is non-nil, a Get for an
+// expired entry returns the stale answer immediately and kicks off an
+// asynchronous refresh instead of failing.
+func NewQueryCache(maxcount, prefetchTTL int, refresher Refresher) *QueryCache {
+	return NewQueryCacheWithBackend(maxcount, prefetchTTL, refresher, newMemoryBackend())
+}
+
+// NewQueryCacheWithBackend is like NewQueryCache but stores entries in the
+// given Backend instead of the default in-process map, e.g. RedisBackend
+// or BadgerBackend so a warm cache can be shared across instances or
+// survive restarts.
+func NewQueryCacheWithBackend(maxcount, prefetchTTL int, refresher Refresher, backend Backend) *QueryCache {
+	return NewQueryCacheWithMetrics(maxcount, prefetchTTL, refresher, backend, nil)
+}
+
+// NewQueryCacheWithMetrics is like NewQueryCacheWithBackend but additionally
+// reports hits, misses, expirations, evictions and entry TTLs through
+// metrics. A nil metrics disables reporting entirely.
+func NewQueryCacheWithMetrics(maxcount, prefetchTTL int, refresher Refresher, backend Backend, metrics *Metrics) *QueryCache {
+	c := &QueryCache{
+		backend:     backend,
+		capacity:    maxcount,
+		prefetchTTL: prefetchTTL,
+		refresher:   refresher,
+		inflight:    make(map[uint64]struct{}),
+		notified:    make(map[uint64]struct{}),
+		metrics:     metrics,
+		stopCh:      make(chan struct{}),
+		done:        make(chan struct{}),
+	}
+
+	go c.run()
+
+	return c
+}
+
+// run periodically evicts entries that are past their TTL and, if
+// configured, their serve-stale window. It only has anything to do for
+// backends it can enumerate; Redis and BadgerDB expire entries themselves
+// from the ttl passed to Backend.Set.
+func (q *QueryCache) run() {
+	defer close(q.done)
+
+	ticker := WallClock.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.Chan():
+			q.evictExpired()
+		case <-q.stopCh:
+			return
+		}
+	}
+}
+
+func (q *QueryCache) evictExpired() {
+	mem, ok := q.backend.(*memoryBackend)
+	if !ok {
+		return
+	}
+
+	now := WallClock.Now()
+
+	for _, key := range mem.keys() {
+		if q.refreshing(key) {
+			continue
+		}
+
+		raw, err := mem.Get(key)
+		if err != nil {
+			continue
+		}
+
+		inserted, msg, err := decodeEntry(raw)
+		if err != nil {
+			mem.Remove(key)
+			continue
+		}
+
+		if now.Sub(inserted) > time.Duration(q.effectiveTTL(msg))*time.Second+q.staleWindow() {
+			mem.Remove(key)
+			q.metrics.recordEviction("ttl")
+			q.observeSize()
+		}
+	}
+}
+
+// observeSize reports the backend's current length to metrics, if
+// configured. The Length() call is skipped entirely when metrics is nil,
+// since on a Backend like Redis or BadgerDB it's an O(n) scan and must
+// not run on every cache write just to be discarded.
+func (q *QueryCache) observeSize() {
+	if q.metrics == nil {
+		return
+	}
+
+	q.metrics.observeSize(q.backend.Length())
+}
+
+func (q *QueryCache) refreshing(key uint64) bool {
+	q.inflightL.Lock()
+	defer q.inflightL.Unlock()
+
+	_, ok := q.inflight[key]
+
+	return ok
+}
+
+func (q *QueryCache) staleWindow() time.Duration {
+	return time.Duration(q.prefetchTTL) * time.Second
+}
+
+// Hash returns a stable key for q. do and cd must reflect the DNSSEC OK
+// (DO) and Checking Disabled (CD) bits of the query that produced q, so
+// that a validating client setting either bit never gets served a
+// filtered or RRSIG-stripped answer cached for a client that didn't.
+func Hash(q dns.Question, do, cd bool) uint64 {
+	h := fnv.New64()
+
+	h.Write([]byte(q.Name))
+	h.Write([]byte{byte(q.Qtype >> 8), byte(q.Qtype)})
+	h.Write([]byte{byte(q.Qclass >> 8), byte(q.Qclass)})
+	h.Write([]byte{boolToByte(do), boolToByte(cd)})
+
+	return h.Sum64()
+}
+
+func boolToByte(b bool) byte {
+	if b {
+		return 1
+	}
+
+	return 0
+}
+
+// DOBit reports whether req set the DNSSEC OK (DO) bit in its EDNS0 OPT
+// record, for use as the do argument to Hash.
+func DOBit(req *dns.Msg) bool {
+	if opt := req.IsEdns0(); opt != nil {
+		return opt.Do()
+	}
+
+	return false
+}
+
+// CDBit reports whether req set the Checking Disabled (CD) header bit,
+// for use as the cd argument to Hash.
+func CDBit(req *dns.Msg) bool {
+	return req.CheckingDisabled
+}
+
+// Stats holds cumulative cache hit counters.
+type Stats struct {
+	PositiveHits uint64
+	NegativeHits uint64
+}
+
+// Stats returns a snapshot of the cache's positive and negative hit
+// counters.
+func (q *QueryCache) Stats() Stats {
+	return Stats{
+		PositiveHits: q.positiveHits.Load(),
+		NegativeHits: q.negativeHits.Load(),
+	}
+}
+
+// SetNegativeTTLBounds configures the floor and ceiling, in seconds,
+// applied to the SOA-derived lifetime of NXDOMAIN/NODATA entries (RFC
+// 2308). Zero leaves the corresponding bound unset.
+func (q *QueryCache) SetNegativeTTLBounds(minNegativeTTL, maxNegativeTTL int) {
+	q.negL.Lock()
+	defer q.negL.Unlock()
+
+	q.minNegativeTTL = minNegativeTTL
+	q.maxNegativeTTL = maxNegativeTTL
+}
+
+func (q *QueryCache) negativeTTLBounds() (min, max int) {
+	q.negL.RLock()
+	defer q.negL.RUnlock()
+
+	return q.minNegativeTTL, q.maxNegativeTTL
+}
+
+// isNegativeResponse reports whether msg is an NXDOMAIN or a NODATA
+// answer (empty Answer section with an SOA in Ns), per RFC 2308.
+func isNegativeResponse(msg *dns.Msg) bool {
+	if msg.Rcode == dns.RcodeNameError {
+		return true
+	}
+
+	if len(msg.Answer) > 0 {
+		return false
+	}
+
+	for _, rr := range msg.Ns {
+		if rr.Header().Rrtype == dns.TypeSOA {
+			return true
+		}
+	}
+
+	return false
+}
+
+// soaTTL returns the RFC 2308 negative-caching TTL derived from the SOA
+// record in msg's authority section: min(SOA.Minttl, SOA.Hdr.Ttl).
+func soaTTL(msg *dns.Msg) (uint32, bool) {
+	for _, rr := range msg.Ns {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+
+		ttl := soa.Minttl
+		if soa.Hdr.Ttl < ttl {
+			ttl = soa.Hdr.Ttl
+		}
+
+		return ttl, true
+	}
+
+	return 0, false
+}
+
+// effectiveTTL returns the lifetime, in seconds, that msg should be
+// cached for: the SOA-derived, bounds-clamped TTL for negative responses,
+// or the minimum answer/authority TTL otherwise.
+func (q *QueryCache) effectiveTTL(msg *dns.Msg) uint32 {
+	if !isNegativeResponse(msg) {
+		return minTTL(msg)
+	}
+
+	ttl, ok := soaTTL(msg)
+	if !ok {
+		return minTTL(msg)
+	}
+
+	minNegativeTTL, maxNegativeTTL := q.negativeTTLBounds()
+
+	if minNegativeTTL > 0 && ttl < uint32(minNegativeTTL) {
+		ttl = uint32(minNegativeTTL)
+	}
+
+	if maxNegativeTTL > 0 && ttl > uint32(maxNegativeTTL) {
+		ttl = uint32(maxNegativeTTL)
+	}
+
+	return ttl
+}
+
+// Set stores msg under key, deriving its lifetime from the minimum TTL
+// found across the answer and authority sections, or, for NXDOMAIN/NODATA
+// responses, from the SOA record clamped to the negative TTL bounds.
+func (q *QueryCache) Set(key uint64, msg *dns.Msg) error {
+	if !q.backend.Exists(key) && q.capacity > 0 && q.backend.Length() >= q.capacity {
+		q.metrics.recordEviction("capacity")
+		return ErrCacheFull
+	}
+
+	raw, err := encodeEntry(WallClock.Now(), msg)
+	if err != nil {
+		return err
+	}
+
+	q.clearNotified(key)
+
+	effTTL := q.effectiveTTL(msg)
+	if err := q.backend.Set(key, raw, time.Duration(effTTL)*time.Second+q.staleWindow()); err != nil {
+		return err
+	}
+
+	q.metrics.observeTTL(effTTL)
+	q.observeSize()
+
+	return nil
+}
+
+// Get returns the cached response for key, with TTLs decremented to
+// reflect the time elapsed since Set. If the entry is expired but still
+// within its serve-stale window, the stale response is returned alongside
+// a nil error and a refresh is triggered asynchronously.
+func (q *QueryCache) Get(key uint64, req *dns.Msg) (*dns.Msg, time.Duration, error) {
+	raw, err := q.backend.Get(key)
+	if err != nil {
+		q.metrics.recordMiss()
+		return nil, 0, ErrCacheNotFound
+	}
+
+	inserted, msg, err := decodeEntry(raw)
+	if err != nil {
+		q.backend.Remove(key)
+		q.metrics.recordMiss()
+
+		return nil, 0, ErrCacheNotFound
+	}
+
+	elapsed := WallClock.Now().Sub(inserted)
+	ttl := time.Duration(q.effectiveTTL(msg)) * time.Second
+
+	if elapsed <= ttl {
+		q.clearNotified(key)
+		q.countHit(msg)
+		q.metrics.recordHit()
+
+		return decrementTTL(msg, elapsed), ttl - elapsed, nil
+	}
+
+	if q.prefetchTTL > 0 && q.refresher != nil && elapsed <= ttl+q.staleWindow() {
+		q.triggerRefresh(key, req)
+		q.countHit(msg)
+		q.metrics.recordHit()
+
+		return decrementTTL(msg, elapsed), 0, nil
+	}
+
+	if q.wasNotified(key) {
+		q.backend.Remove(key)
+		q.clearNotified(key)
+		q.metrics.recordEviction("ttl")
+		q.observeSize()
+
+		return nil, 0, ErrCacheNotFound
+	}
+
+	q.markNotified(key)
+	q.metrics.recordExpired()
+
+	return nil, 0, ErrCacheExpired
+}
+
+func (q *QueryCache) countHit(msg *dns.Msg) {
+	if isNegativeResponse(msg) {
+		q.negativeHits.Add(1)
+	} else {
+		q.positiveHits.Add(1)
+	}
+}
+
+func (q *QueryCache) markNotified(key uint64) {
+	q.notifiedL.Lock()
+	defer q.notifiedL.Unlock()
+
+	q.notified[key] = struct{}{}
+}
+
+func (q *QueryCache) wasNotified(key uint64) bool {
+	q.notifiedL.Lock()
+	defer q.notifiedL.Unlock()
+
+	_, ok := q.notified[key]
+
+	return ok
+}
+
+func (q *QueryCache) clearNotified(key uint64) {
+	q.notifiedL.Lock()
+	defer q.notifiedL.Unlock()
+
+	delete(q.notified, key)
+}
+
+// triggerRefresh asks the refresher for a fresh answer to req, deduplicating
+// concurrent refreshes of the same key via singleflight so a burst of
+// queries for a stale entry only reaches upstream once.
+func (q *QueryCache) triggerRefresh(key uint64, req *dns.Msg) {
+	if q.refresher == nil {
+		return
+	}
+
+	sfKey := strconv.FormatUint(key, 10)
+
+	q.inflightL.Lock()
+	if _, ok := q.inflight[key]; ok {
+		q.inflightL.Unlock()
+		return
+	}
+	q.inflight[key] = struct{}{}
+	q.inflightL.Unlock()
+
+	go func() {
+		defer func() {
+			q.inflightL.Lock()
+			delete(q.inflight, key)
+			q.inflightL.Unlock()
+		}()
+
+		q.sf.Do(sfKey, func() (interface{}, error) {
+			msg, err := q.refresher(req)
+			if err != nil {
+				return nil, err
+			}
+
+			_ = q.Set(key, msg)
+
+			return msg, nil
+		})
+	}()
+}
+
+// Exists reports whether key is currently cached, without decrementing or
+// checking its TTL.
+func (q *QueryCache) Exists(key uint64) bool {
+	return q.backend.Exists(key)
+}
+
+// Remove deletes key from the cache, if present.
+func (q *QueryCache) Remove(key uint64) {
+	q.backend.Remove(key)
+	q.metrics.recordEviction("manual")
+	q.observeSize()
+}
+
+// Length returns the number of entries currently cached.
+func (q *QueryCache) Length() int {
+	return q.backend.Length()
+}
+
+// Stop halts the background eviction goroutine and waits for it to exit.
+// It is safe to call once.
+func (q *QueryCache) Stop() {
+	close(q.stopCh)
+	<-q.done
+}
+
+// clear empties the cache. It is unexported; callers should let entries
+// expire naturally outside of tests.
+func (q *QueryCache) clear() {
+	q.backend.clear()
+
+	q.notifiedL.Lock()
+	q.notified = make(map[uint64]struct{})
+	q.notifiedL.Unlock()
+}
+
+// encodeEntry serializes msg for storage, prefixed with inserted as a
+// big-endian unix timestamp in nanoseconds so the backend can be a dumb byte store and
+// TTL decrement logic still works when the entry is read back.
+func encodeEntry(inserted time.Time, msg *dns.Msg) ([]byte, error) {
+	packed, err := msg.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, timestampLen+len(packed))
+	binary.BigEndian.PutUint64(buf[:timestampLen], uint64(inserted.UnixNano()))
+	copy(buf[timestampLen:], packed)
+
+	return buf, nil
+}
+
+func decodeEntry(raw []byte) (time.Time, *dns.Msg, error) {
+	if len(raw) < timestampLen {
+		return time.Time{}, nil, errors.New("cache: truncated entry")
+	}
+
+	inserted := time.Unix(0, int64(binary.BigEndian.Uint64(raw[:timestampLen])))
+
+	msg := new(dns.Msg)
+	if err := msg.Unpack(raw[timestampLen:]); err != nil {
+		return time.Time{}, nil, err
+	}
+
+	return inserted, msg, nil
+}
+
+func minTTL(msg *dns.Msg) uint32 {
+	var ttl uint32
+
+	first := true
+
+	for _, rr := range msg.Answer {
+		if first || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			first = false
+		}
+	}
+
+	for _, rr := range msg.Ns {
+		if first || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+			first = false
+		}
+	}
+
+	return ttl
+}
+
+// decrementTTL mutates msg in place, lowering every answer/authority TTL
+// by elapsed. msg is always a freshly unpacked copy owned by the caller,
+// so there's no shared state to protect here.
+func decrementTTL(msg *dns.Msg, elapsed time.Duration) *dns.Msg {
+	secs := uint32(elapsed / time.Second)
+
+	for _, rr := range msg.Answer {
+		rr.Header().Ttl = subUint32(rr.Header().Ttl, secs)
+	}
+
+	for _, rr := range msg.Ns {
+		rr.Header().Ttl = subUint32(rr.Header().Ttl, secs)
+	}
+
+	return msg
+}
+
+func subUint32(a, b uint32) uint32 {
+	if b >= a {
+		return 0
+	}
+
+	return a - b
+}
@@ -2,26 +2,36 @@ package cache
 
 import (
 	"net"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/jonboulle/clockwork"
 	"github.com/miekg/dns"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 )
 
-func makeCache(maxcount int) *QueryCache {
-	return NewQueryCache(maxcount, 0)
+const testDomain = "www.google.com"
+
+func makeCache(t *testing.T, maxcount int) *QueryCache {
+	t.Helper()
+
+	cache := NewQueryCache(maxcount, 0, nil)
+	t.Cleanup(cache.Stop)
+
+	return cache
 }
 
 func Test_Cache(t *testing.T) {
-	cache := makeCache(1)
 	WallClock = clockwork.NewFakeClock()
+	cache := makeCache(t, 1)
 
 	m := new(dns.Msg)
 	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
 
-	key := Hash(m.Question[0])
+	key := Hash(m.Question[0], false, false)
 
 	if err := cache.Set(key, m); err != nil {
 		t.Error(err)
@@ -35,7 +45,7 @@ func Test_Cache(t *testing.T) {
 
 	m2 := new(dns.Msg)
 	m2.SetQuestion("test2.com.", dns.TypeA)
-	err := cache.Set(Hash(m2.Question[0]), m2)
+	err := cache.Set(Hash(m2.Question[0], false, false), m2)
 	assert.Error(t, err)
 	assert.Equal(t, err.Error(), "capacity full")
 
@@ -55,7 +65,10 @@ func Test_CacheTTL(t *testing.T) {
 
 	fakeClock := clockwork.NewFakeClock()
 	WallClock = fakeClock
-	cache := makeCache(0)
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+	cache := NewQueryCacheWithMetrics(0, 0, nil, newMemoryBackend(), metrics)
+	t.Cleanup(cache.Stop)
 
 	req := new(dns.Msg)
 	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
@@ -63,7 +76,7 @@ func Test_CacheTTL(t *testing.T) {
 	m := new(dns.Msg)
 	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
 
-	key := Hash(m.Question[0])
+	key := Hash(m.Question[0], false, false)
 
 	var attl uint32 = 10
 	var aaaattl uint32 = 20
@@ -73,7 +86,7 @@ func Test_CacheTTL(t *testing.T) {
 
 	a := &dns.A{
 		Hdr: dns.RR_Header{
-			Name:   testDomain,
+			Name:   dns.Fqdn(testDomain),
 			Rrtype: dns.TypeA,
 			Class:  dns.ClassINET,
 			Ttl:    attl,
@@ -83,7 +96,7 @@ func Test_CacheTTL(t *testing.T) {
 
 	aaaa := &dns.AAAA{
 		Hdr: dns.RR_Header{
-			Name:   testDomain,
+			Name:   dns.Fqdn(testDomain),
 			Rrtype: dns.TypeAAAA,
 			Class:  dns.ClassINET,
 			Ttl:    aaaattl,
@@ -93,12 +106,12 @@ func Test_CacheTTL(t *testing.T) {
 
 	ns := &dns.NS{
 		Hdr: dns.RR_Header{
-			Name:   testDomain,
+			Name:   dns.Fqdn(testDomain),
 			Rrtype: dns.TypeNS,
 			Class:  dns.ClassINET,
 			Ttl:    nsttl,
 		},
-		Ns: "localhost"}
+		Ns: "localhost."}
 	m.Ns = append(m.Ns, ns)
 
 	if err := cache.Set(key, m); err != nil {
@@ -191,6 +204,10 @@ func Test_CacheTTL(t *testing.T) {
 		t.Error("cache entry still existed after expiring - ", err)
 	}
 	assert.Equal(t, err.Error(), "cache not found")
+
+	// even though the expired key was fetched twice back-to-back, the
+	// expiration should only have been counted once.
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.expired))
 }
 
 func Test_CacheTTLFrequentPolling(t *testing.T) {
@@ -200,7 +217,7 @@ func Test_CacheTTLFrequentPolling(t *testing.T) {
 
 	fakeClock := clockwork.NewFakeClock()
 	WallClock = fakeClock
-	cache := makeCache(0)
+	cache := makeCache(t, 0)
 
 	req := new(dns.Msg)
 	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
@@ -208,7 +225,7 @@ func Test_CacheTTLFrequentPolling(t *testing.T) {
 	m := new(dns.Msg)
 	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
 
-	key := Hash(m.Question[0])
+	key := Hash(m.Question[0], false, false)
 
 	var attl uint32 = 10
 	var nsttl uint32 = 5
@@ -216,7 +233,7 @@ func Test_CacheTTLFrequentPolling(t *testing.T) {
 	nullroute := net.ParseIP("0.0.0.0")
 	a := &dns.A{
 		Hdr: dns.RR_Header{
-			Name:   testDomain,
+			Name:   dns.Fqdn(testDomain),
 			Rrtype: dns.TypeA,
 			Class:  dns.ClassINET,
 			Ttl:    attl,
@@ -226,12 +243,12 @@ func Test_CacheTTLFrequentPolling(t *testing.T) {
 
 	ns := &dns.NS{
 		Hdr: dns.RR_Header{
-			Name:   testDomain,
+			Name:   dns.Fqdn(testDomain),
 			Rrtype: dns.TypeNS,
 			Class:  dns.ClassINET,
 			Ttl:    nsttl,
 		},
-		Ns: "localhost"}
+		Ns: "localhost."}
 	m.Ns = append(m.Ns, ns)
 
 	if err := cache.Set(key, m); err != nil {
@@ -277,4 +294,206 @@ func Test_CacheTTLFrequentPolling(t *testing.T) {
 	if cache.Length() != 0 {
 		t.Error("cache should be clear")
 	}
-}
\ No newline at end of file
+}
+
+func Test_CacheServeStale(t *testing.T) {
+	const testDomain = "www.google.com"
+
+	fakeClock := clockwork.NewFakeClock()
+	WallClock = fakeClock
+
+	var refreshed int32
+
+	refresher := func(req *dns.Msg) (*dns.Msg, error) {
+		atomic.AddInt32(&refreshed, 1)
+
+		fresh := new(dns.Msg)
+		fresh.SetReply(req)
+		fresh.Answer = append(fresh.Answer, &dns.A{
+			Hdr: dns.RR_Header{Name: dns.Fqdn(testDomain), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+			A:   net.ParseIP("0.0.0.0"),
+		})
+
+		return fresh, nil
+	}
+
+	cache := NewQueryCache(0, 30, refresher)
+	t.Cleanup(cache.Stop)
+
+	req := new(dns.Msg)
+	req.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(testDomain), dns.TypeA)
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(testDomain), Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+		A:   net.ParseIP("0.0.0.0"),
+	})
+
+	key := Hash(m.Question[0], false, false)
+
+	assert.NoError(t, cache.Set(key, m))
+
+	// Past the TTL but inside the 30s stale window: the stale answer is
+	// served and a refresh is triggered in the background.
+	fakeClock.Advance(11 * time.Second)
+
+	msg, ttl, err := cache.Get(key, req)
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), ttl)
+	assert.Equal(t, uint32(0), msg.Answer[0].Header().Ttl)
+
+	// Let the asynchronous refresh run until the refresher has been called.
+	for i := 0; i < 100 && atomic.LoadInt32(&refreshed) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&refreshed))
+}
+
+func Test_HashDOCD(t *testing.T) {
+	q := dns.Question{Name: "example.com.", Qtype: dns.TypeA, Qclass: dns.ClassINET}
+
+	plain := Hash(q, false, false)
+	withDO := Hash(q, true, false)
+	withCD := Hash(q, false, true)
+	withBoth := Hash(q, true, true)
+
+	assert.NotEqual(t, plain, withDO, "DO bit should change the cache key")
+	assert.NotEqual(t, plain, withCD, "CD bit should change the cache key")
+	assert.NotEqual(t, withDO, withBoth, "CD bit should change the cache key even when DO is set")
+	assert.Equal(t, plain, Hash(q, false, false), "hashing the same question and bits must be stable")
+}
+
+func Test_DOBitAndCDBit(t *testing.T) {
+	req := new(dns.Msg)
+	req.SetQuestion("example.com.", dns.TypeA)
+	assert.False(t, DOBit(req))
+	assert.False(t, CDBit(req))
+
+	req.SetEdns0(4096, true)
+	assert.True(t, DOBit(req))
+
+	req.CheckingDisabled = true
+	assert.True(t, CDBit(req))
+}
+
+func Test_NegativeCache(t *testing.T) {
+	const zone = "example.com."
+
+	fakeClock := clockwork.NewFakeClock()
+	WallClock = fakeClock
+	cache := makeCache(t, 0)
+
+	// NXDOMAIN for a name in the zone, with a 30s SOA minimum.
+	neg := new(dns.Msg)
+	neg.SetQuestion("nxdomain."+zone, dns.TypeA)
+	neg.Rcode = dns.RcodeNameError
+	neg.Ns = append(neg.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns1." + zone,
+		Mbox:   "hostmaster." + zone,
+		Minttl: 30,
+	})
+	negKey := Hash(neg.Question[0], false, false)
+	assert.NoError(t, cache.Set(negKey, neg))
+
+	// A positive A record for the zone apex, with a much longer TTL.
+	pos := new(dns.Msg)
+	pos.SetQuestion(zone, dns.TypeA)
+	pos.Answer = append(pos.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: zone, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 3600},
+		A:   net.ParseIP("1.2.3.4"),
+	})
+	posKey := Hash(pos.Question[0], false, false)
+	assert.NoError(t, cache.Set(posKey, pos))
+
+	// Just past the SOA minimum: the negative entry has expired even
+	// though the SOA record's own TTL (3600s) hasn't, while the positive
+	// entry (keyed off the 3600s A record) is still fresh.
+	fakeClock.Advance(31 * time.Second)
+
+	_, _, err := cache.Get(negKey, neg)
+	assert.Equal(t, ErrCacheExpired, err)
+
+	msg, _, err := cache.Get(posKey, pos)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(3600-31), msg.Answer[0].Header().Ttl)
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.PositiveHits)
+	assert.Equal(t, uint64(0), stats.NegativeHits)
+}
+
+func Test_NegativeCacheTTLBounds(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	WallClock = fakeClock
+	cache := makeCache(t, 0)
+	cache.SetNegativeTTLBounds(60, 120)
+
+	neg := new(dns.Msg)
+	neg.SetQuestion("nxdomain.example.com.", dns.TypeA)
+	neg.Rcode = dns.RcodeNameError
+	neg.Ns = append(neg.Ns, &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns1.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: 30,
+	})
+	key := Hash(neg.Question[0], false, false)
+	assert.NoError(t, cache.Set(key, neg))
+
+	// The SOA minimum (30s) is below MinNegativeTTL (60s), so the floor wins.
+	fakeClock.Advance(45 * time.Second)
+	_, _, err := cache.Get(key, neg)
+	assert.NoError(t, err)
+
+	fakeClock.Advance(16 * time.Second) // 61s total, past the 60s floor
+	_, _, err = cache.Get(key, neg)
+	assert.Equal(t, ErrCacheExpired, err)
+
+	stats := cache.Stats()
+	assert.Equal(t, uint64(1), stats.NegativeHits)
+}
+
+func Test_CacheMetrics(t *testing.T) {
+	fakeClock := clockwork.NewFakeClock()
+	WallClock = fakeClock
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+	cache := NewQueryCacheWithMetrics(1, 0, nil, newMemoryBackend(), metrics)
+	t.Cleanup(cache.Stop)
+
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeA)
+	m.Answer = append(m.Answer, &dns.A{
+		Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 10},
+		A:   net.ParseIP("1.2.3.4"),
+	})
+	key := Hash(m.Question[0], false, false)
+
+	// a miss before anything is stored
+	_, _, err := cache.Get(key, m)
+	assert.Equal(t, ErrCacheNotFound, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.misses))
+
+	assert.NoError(t, cache.Set(key, m))
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.size))
+
+	// a hit
+	_, _, err = cache.Get(key, m)
+	assert.NoError(t, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.hits))
+
+	// capacity is full: the second distinct key is rejected and counted
+	// as a capacity eviction.
+	m2 := new(dns.Msg)
+	m2.SetQuestion("other.com.", dns.TypeA)
+	err = cache.Set(Hash(m2.Question[0], false, false), m2)
+	assert.Equal(t, ErrCacheFull, err)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.evictions.WithLabelValues("capacity")))
+
+	cache.Remove(key)
+	assert.Equal(t, float64(1), testutil.ToFloat64(metrics.evictions.WithLabelValues("manual")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(metrics.size))
+}
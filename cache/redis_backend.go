@@ -0,0 +1,70 @@
+package cache
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RedisBackend persists entries in Redis so a warm cache can be shared
+// across sdns instances and survive restarts. Keys are namespaced under
+// keyPrefix to make it safe to share a Redis instance with other data.
+type RedisBackend struct {
+	client    *redis.Client
+	keyPrefix string
+}
+
+// NewRedisBackend returns a Backend backed by the given Redis client.
+// keyPrefix is prepended to every key sdns stores, e.g. "sdns:cache:".
+func NewRedisBackend(client *redis.Client, keyPrefix string) *RedisBackend {
+	return &RedisBackend{client: client, keyPrefix: keyPrefix}
+}
+
+func (b *RedisBackend) redisKey(key uint64) string {
+	return b.keyPrefix + strconv.FormatUint(key, 10)
+}
+
+func (b *RedisBackend) Set(key uint64, data []byte, ttl time.Duration) error {
+	return b.client.Set(context.Background(), b.redisKey(key), data, ttl).Err()
+}
+
+func (b *RedisBackend) Get(key uint64) ([]byte, error) {
+	data, err := b.client.Get(context.Background(), b.redisKey(key)).Bytes()
+	if err == redis.Nil {
+		return nil, ErrCacheNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (b *RedisBackend) Exists(key uint64) bool {
+	n, err := b.client.Exists(context.Background(), b.redisKey(key)).Result()
+
+	return err == nil && n > 0
+}
+
+func (b *RedisBackend) Remove(key uint64) {
+	b.client.Del(context.Background(), b.redisKey(key))
+}
+
+func (b *RedisBackend) Length() int {
+	keys, err := b.client.Keys(context.Background(), b.keyPrefix+"*").Result()
+	if err != nil {
+		return 0
+	}
+
+	return len(keys)
+}
+
+func (b *RedisBackend) clear() {
+	keys, err := b.client.Keys(context.Background(), b.keyPrefix+"*").Result()
+	if err != nil || len(keys) == 0 {
+		return
+	}
+
+	b.client.Del(context.Background(), keys...)
+}